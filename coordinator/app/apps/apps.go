@@ -16,6 +16,13 @@ type App struct {
 	Type      string   `yaml:"type" json:"type"`
 	PosterURL string   `yaml:"poster_url" json:"posterURL"`
 	Device    []string `yaml:"device" json:"device"`
+
+	// InitialBitrate, MinBitrate and MaxBitrate (bps) bound the
+	// congestion controller's encoder bitrate for sessions running this
+	// app. Zero means "use webrtc package defaults".
+	InitialBitrate int `yaml:"initial_bitrate" json:"initialBitrate"`
+	MinBitrate     int `yaml:"min_bitrate" json:"minBitrate"`
+	MaxBitrate     int `yaml:"max_bitrate" json:"maxBitrate"`
 }
 
 var appList []*App
@@ -43,6 +50,16 @@ func init() {
 	}
 }
 
+// GetApp looks up an app from appconf/apps.yml by name.
+func GetApp(name string) (*App, bool) {
+	for _, app := range appList {
+		if app.Name == name {
+			return app, true
+		}
+	}
+	return nil, false
+}
+
 type GetAppListResponse struct {
 	Apps []*App `json:"apps"`
 }
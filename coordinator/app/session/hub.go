@@ -0,0 +1,298 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"coordinator/app/webrtc"
+	"coordinator/app/ws"
+	"coordinator/constants"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+)
+
+// SessionHub owns the VM/relayer's video and audio streams for one session
+// and multiplexes every RTP packet out to the interactive owner plus any
+// number of read-only spectators, so a single game VM can be shared by
+// several viewers. Only the owner's data-channel messages are ever forwarded
+// to the VM's inputStream - see webrtc.NewWebRTC.
+type SessionHub struct {
+	id string
+
+	videoStream chan *rtp.Packet
+	audioStream chan *rtp.Packet
+
+	mu    sync.RWMutex
+	owner *webrtc.WebRTC
+	peers map[string]*webrtc.WebRTC
+
+	teardown        func()
+	teardownOnce    sync.Once
+	requestKeyframe func()
+
+	keyframeMu        sync.Mutex
+	keyframeDebounce  time.Duration
+	lastKeyframeAskAt time.Time
+}
+
+func newSessionHub(id string, videoStream, audioStream chan *rtp.Packet, teardown func(), requestKeyframe func()) *SessionHub {
+	return &SessionHub{
+		id:               id,
+		videoStream:      videoStream,
+		audioStream:      audioStream,
+		peers:            make(map[string]*webrtc.WebRTC),
+		teardown:         teardown,
+		requestKeyframe:  requestKeyframe,
+		keyframeDebounce: webrtc.DefaultKeyframeDebounce,
+	}
+}
+
+// RequestKeyframe asks the VM for a fresh keyframe, debounced across every
+// owner/spectator connection attached to the hub so N viewers hitting
+// packet loss at once still only ask the VM once per keyframeDebounce -
+// each webrtc.WebRTC's own RTCP reader has no debounce of its own, see
+// webrtc.OnKeyframeCallback.
+func (h *SessionHub) RequestKeyframe() {
+	if h.requestKeyframe == nil {
+		return
+	}
+
+	h.keyframeMu.Lock()
+	if time.Since(h.lastKeyframeAskAt) < h.keyframeDebounce {
+		h.keyframeMu.Unlock()
+		return
+	}
+	h.lastKeyframeAskAt = time.Now()
+	h.keyframeMu.Unlock()
+
+	h.requestKeyframe()
+}
+
+// run starts the fan-out goroutines. It must only be called once.
+func (h *SessionHub) run() {
+	go func() {
+		for packet := range h.videoStream {
+			h.broadcast(func(conn *webrtc.WebRTC) {
+				if err := conn.WriteVideoRTP(packet); err != nil {
+					log.Printf("[%s] Error when writing RTP to video track: %s\n", h.id, err)
+				}
+			})
+		}
+	}()
+
+	go func() {
+		for packet := range h.audioStream {
+			h.broadcast(func(conn *webrtc.WebRTC) {
+				if err := conn.WriteAudioRTP(packet); err != nil {
+					log.Printf("[%s] Error when writing RTP to opus track: %s\n", h.id, err)
+				}
+			})
+		}
+	}()
+}
+
+// broadcast writes to every attached connection whose ICE has finished
+// connecting, skipping the rest: a connection isn't ready to receive RTP
+// before then, and webrtc.WebRTC.setConnected already asks the VM for a
+// fresh keyframe the moment a connection becomes ready, so a peer that
+// attaches mid-negotiation gets a full picture promptly instead of
+// sitting on whatever packets arrived before it was ready to decode them.
+func (h *SessionHub) broadcast(write func(*webrtc.WebRTC)) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.owner != nil && h.owner.Connected() {
+		write(h.owner)
+	}
+	for _, peer := range h.peers {
+		if peer.Connected() {
+			write(peer)
+		}
+	}
+}
+
+// AttachOwner registers the interactive player's connection.
+func (h *SessionHub) AttachOwner(conn *webrtc.WebRTC) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.owner = conn
+}
+
+// DetachOwner removes the owner and always tears the session down: once the
+// player leaves, the VM is done regardless of any spectators still watching.
+func (h *SessionHub) DetachOwner() {
+	h.mu.Lock()
+	h.owner = nil
+	h.mu.Unlock()
+
+	h.teardownOnce.Do(h.teardown)
+}
+
+// AttachSpectator registers a read-only viewer under peerID.
+func (h *SessionHub) AttachSpectator(peerID string, conn *webrtc.WebRTC) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.peers[peerID] = conn
+}
+
+// DetachSpectator removes a viewer. If the owner has already left and this
+// was the last remaining spectator, the session is torn down.
+func (h *SessionHub) DetachSpectator(peerID string) {
+	h.mu.Lock()
+	delete(h.peers, peerID)
+	ownerGone := h.owner == nil
+	remaining := len(h.peers)
+	h.mu.Unlock()
+
+	if ownerGone && remaining == 0 {
+		h.teardownOnce.Do(h.teardown)
+	}
+}
+
+var (
+	hubs   = map[string]*SessionHub{}
+	hubsMu sync.Mutex
+)
+
+func registerHub(id string, hub *SessionHub) {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	hubs[id] = hub
+}
+
+func unregisterHub(id string) {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	delete(hubs, id)
+}
+
+// GetHub looks up the hub for an already-running session, e.g. so a
+// spectator can attach to it.
+func GetHub(id string) (*SessionHub, bool) {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	hub, ok := hubs[id]
+	return hub, ok
+}
+
+func newPeerID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func startSpectatorSession(ownerID string, wsConn *ws.Connection) (*webrtc.WebRTC, error) {
+	hub, ok := GetHub(ownerID)
+	if !ok {
+		return nil, fmt.Errorf("no active session %q to spectate", ownerID)
+	}
+
+	peerID, err := newPeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	// No inputStream: spectators are read-only and may never drive input.
+	// Bitrate bounds don't apply to a spectator's own connection (it rides
+	// the owner's encoder output), so no app name is needed here.
+	webrtcConn, err := webrtc.NewWebRTC(peerID, nil, webrtcConfig(""))
+	if err != nil {
+		return nil, err
+	}
+
+	onIceCandidateCb := func(candidate string) {
+		if err := sendIceCandidate(wsConn, candidate); err != nil {
+			log.Printf("[%s] Couldn't send candidate: %s\n", peerID, err)
+		}
+	}
+	onExitCb := func() {
+		webrtcConn.StopClient()
+		hub.DetachSpectator(peerID)
+	}
+
+	offer, err := webrtcConn.StartClient("vpx", onIceCandidateCb, onExitCb, hub.RequestKeyframe)
+	if err != nil {
+		return nil, err
+	}
+
+	hub.AttachSpectator(peerID, webrtcConn)
+
+	if err := sendOffer(wsConn, offer); err != nil {
+		hub.DetachSpectator(peerID)
+		return nil, err
+	}
+
+	return webrtcConn, nil
+}
+
+// JoinAsSpectator is the WS entry point for attaching an additional
+// read-only peer connection to an already-running session, identified by
+// the `session` query parameter. It mirrors NewSession's message loop but
+// drives startSpectatorSession instead of provisioning a new VM.
+func JoinAsSpectator(w http.ResponseWriter, r *http.Request) {
+	ownerID := r.URL.Query().Get("session")
+	if ownerID == "" {
+		http.Error(w, "Missing session query parameter", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := ws.NewWsConnection(w, r)
+	if err != nil {
+		log.Printf("[%s] Couldn't upgrade spectator connection: %s\n", ownerID, err)
+		return
+	}
+	defer conn.Close()
+
+	var webrtcConn *webrtc.WebRTC
+
+	for {
+		rawMsg, err := conn.ReadText()
+		if err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == websocket.CloseGoingAway {
+				return
+			}
+
+			log.Printf("[%s] Error when read WS message: %s\n", ownerID, err)
+			return
+		}
+
+		var msg ws.Message
+		if err := json.Unmarshal(rawMsg, &msg); err != nil {
+			log.Printf("[%s] Error when parse WS message: %s\n", ownerID, err)
+			continue
+		}
+
+		switch msg.Type {
+		case constants.StartMessage:
+			webrtcConn, err = startSpectatorSession(ownerID, conn)
+			if err != nil {
+				log.Printf("[%s] Error when joining as spectator: %s\n", ownerID, err)
+				webrtcConn = nil
+			}
+		case constants.SDPMessage:
+			if webrtcConn == nil {
+				continue
+			}
+			if err := webrtcConn.SetRemoteSDP(msg.Data); err != nil {
+				log.Printf("[%s] Couldn't set remote SDP %s\n", ownerID, err)
+				webrtcConn = nil
+			}
+		case constants.IceCandidateMessage:
+			if webrtcConn == nil {
+				continue
+			}
+			if err := webrtcConn.AddCandidate(msg.Data); err != nil {
+				log.Printf("[%s] Couldn't set ICE candidate %s\n", ownerID, err)
+			}
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package session
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"os/exec"
-	"strconv"
+	"sync"
 
+	"coordinator/app/apps"
 	"coordinator/app/stream"
+	"coordinator/app/vm"
 	"coordinator/app/webrtc"
 	"coordinator/app/ws"
 	"coordinator/constants"
@@ -19,32 +21,27 @@ import (
 	"github.com/pion/rtp"
 )
 
-func startVM(id string, videoRelayPort, audioRelayPort, winePort int) error {
-	log.Printf("[%s] Spinning off VM\n", id)
-
-	params := []string{
-		id,
-		strconv.Itoa(videoRelayPort),
-		strconv.Itoa(audioRelayPort),
-		strconv.Itoa(winePort),
-	}
-	cmd := exec.Command("./startVM.sh", params...)
-	if err := cmd.Start(); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func stopVM(id string) error {
-	log.Printf("[%s] Stopping VM\n", id)
+var (
+	vmBackendOnce sync.Once
+	vmBackendInst vm.Backend
+)
 
-	cmd := exec.Command("./stopVM.sh", id)
-	if err := cmd.Start(); err != nil {
-		return err
-	}
+// vmBackend lazily builds the operator-configured VM backend the first
+// time it's needed. An unknown backend name, or a Docker backend whose
+// client can't be created, falls back to the original shell scripts
+// instead of panicking at startup; "kubernetes" never falls back, since
+// constructing it can't fail.
+func vmBackend() vm.Backend {
+	vmBackendOnce.Do(func() {
+		backend, err := vm.NewBackend(settings.VMBackend)
+		if err != nil {
+			log.Printf("Couldn't initialize %q VM backend, falling back to scripts: %s\n", settings.VMBackend, err)
+			backend = vm.NewScriptBackend()
+		}
+		vmBackendInst = backend
+	})
 
-	return nil
+	return vmBackendInst
 }
 
 func sendIceCandidate(wsConn *ws.Connection, candidate string) error {
@@ -61,7 +58,53 @@ func sendOffer(wsConn *ws.Connection, offer string) error {
 	})
 }
 
-func startSession(id string, wsConn *ws.Connection) (*webrtc.WebRTC, error) {
+// webrtcConfig builds a webrtc.Config from operator settings instead of the
+// single hardcoded STUN server, so deployments behind cloud NAT or
+// restrictive networks can supply real TURN credentials, an ephemeral UDP
+// port range, a single ICE-mux port, and/or a NAT 1-to-1 IP mapping.
+// appName, if it names a known app, overrides the default encoder bitrate
+// bounds with that app's appconf/apps.yml values.
+func webrtcConfig(appName string) *webrtc.Config {
+	iceServers := []webrtc.ICEServer{{URLs: []string{settings.StunURL}}}
+	if settings.TurnURL != "" {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       []string{settings.TurnURL},
+			Username:   settings.TurnUsername,
+			Credential: settings.TurnCredential,
+		})
+	}
+
+	conf := &webrtc.Config{
+		ICEServers: iceServers,
+		PortRange: webrtc.PortRange{
+			Min: settings.ICEPortMin,
+			Max: settings.ICEPortMax,
+		},
+		SinglePort: settings.ICESinglePort,
+		IceIpMap:   settings.NAT1To1IP,
+		ICETimeouts: webrtc.ICETimeouts{
+			Disconnected: settings.ICEDisconnectedTimeout,
+			Failed:       settings.ICEFailedTimeout,
+			KeepAlive:    settings.ICEKeepAliveInterval,
+		},
+	}
+
+	if app, ok := apps.GetApp(appName); ok {
+		conf.InitialBitrate = app.InitialBitrate
+		conf.MinBitrate = app.MinBitrate
+		conf.MaxBitrate = app.MaxBitrate
+	}
+
+	return conf
+}
+
+// ProvisionSession spins up the VM and relaying streams for session id and
+// returns the resulting WebRTC peer connection along with the cleanup
+// callback that releases all of it. It's shared by every signaling
+// transport (WebSocket, WHEP) since none of this setup is specific to
+// how the offer/answer actually gets exchanged. appName selects the
+// per-app bitrate bounds from appconf/apps.yml, see webrtcConfig.
+func ProvisionSession(id, appName string) (*webrtc.WebRTC, func(), error) {
 	// Create relaying streams
 	videoStream := make(chan *rtp.Packet, 100)
 	audioStream := make(chan *rtp.Packet, 100)
@@ -70,32 +113,32 @@ func startSession(id string, wsConn *ws.Connection) (*webrtc.WebRTC, error) {
 	videoListener, err := socket.NewRandomUDPListener()
 	if err != nil {
 		log.Printf("[%s] Couldn't create a UDP listener for video: %s\n", id, err)
-		return nil, err
+		return nil, nil, err
 	}
 	videoRelayPort, err := socket.ExtractPort(videoListener.LocalAddr().String())
 	if err != nil {
 		log.Printf("[%s] Couldn't extract UDP port for video: %s\n", id, err)
-		return nil, err
+		return nil, nil, err
 	}
 	audioListener, err := socket.NewRandomUDPListener()
 	if err != nil {
 		log.Printf("[%s] Couldn't create a UDP listener for audio: %s\n", id, err)
-		return nil, err
+		return nil, nil, err
 	}
 	audioRelayPort, err := socket.ExtractPort(audioListener.LocalAddr().String())
 	if err != nil {
 		log.Printf("[%s] Couldn't extract UDP port for audio: %s\n", id, err)
-		return nil, err
+		return nil, nil, err
 	}
 	wineListener, err := socket.NewRandomTCPListener()
 	if err != nil {
 		log.Printf("[%s] Couldn't create a TCP listener for wine: %s\n", id, err)
-		return nil, err
+		return nil, nil, err
 	}
 	winePort, err := socket.ExtractPort(wineListener.Addr().String())
 	if err != nil {
 		log.Printf("[%s] Couldn't extract TCP port for wine: %s\n", id, err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	log.Printf("[%s] Wait for video at port %d\n", id, videoRelayPort)
@@ -108,44 +151,29 @@ func startSession(id string, wsConn *ws.Connection) (*webrtc.WebRTC, error) {
 		settings.ScreenWidth, settings.ScreenHeight)
 	if err := relayer.Start(); err != nil {
 		fmt.Printf("[%s] Couldn't start relaying streams: %s\n", id, err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Start VM
-	if err := startVM(id, videoRelayPort, audioRelayPort, winePort); err != nil {
-		log.Printf("[%s] Error when start VM: %s\n", id, err)
-		return nil, err
-	}
-
-	// Start WebRTC
-	webrtcConf := &webrtc.Config{
-		//SinglePort:                 8443,
-		//DisableDefaultInterceptors: true,
-	}
-	webrtcConn, err := webrtc.NewWebRTC(id,
-		videoStream, audioStream, inputStream,
-		webrtcConf,
-	)
+	backend := vmBackend()
+	vmHandle, err := backend.Start(context.Background(), id, vm.VMPorts{
+		Video: videoRelayPort,
+		Audio: audioRelayPort,
+		Wine:  winePort,
+	})
 	if err != nil {
-		return nil, err
+		log.Printf("[%s] Error when start VM: %s\n", id, err)
+		return nil, nil, err
 	}
 
-	onIceCandidateCb := func(candidate string) {
-		err := sendIceCandidate(wsConn, candidate)
-		if err != nil {
-			log.Printf("[%s] Couldn't send candidate: %s\n", id, err)
-		}
-	}
-	onExitCb := func() {
+	hub := newSessionHub(id, videoStream, audioStream, func() {
 		log.Printf("[%s] Releasing allocated resources", id)
+		unregisterHub(id)
 
-		if err := stopVM(id); err != nil {
+		if err := backend.Stop(context.Background(), vmHandle); err != nil {
 			log.Printf("[%s] Error when stopping VM: %s\n", id, err)
 		}
 
-		// Must close webrtc connection first to ensure no writing to closed inputStream
-		webrtcConn.StopClient()
-
 		// Must close listeners before streams to ensure no writing to closed channels
 		_ = audioListener.Close()
 		_ = videoListener.Close()
@@ -156,8 +184,53 @@ func startSession(id string, wsConn *ws.Connection) (*webrtc.WebRTC, error) {
 		close(inputStream)
 
 		relayer.Close()
+	}, func() {
+		if err := relayer.RequestKeyframe(); err != nil {
+			log.Printf("[%s] Couldn't request keyframe from VM: %s\n", id, err)
+		}
+	})
+	hub.run()
+	registerHub(id, hub)
+
+	// Start WebRTC
+	webrtcConn, err := webrtc.NewWebRTC(id, inputStream, webrtcConfig(appName))
+	if err != nil {
+		hub.DetachOwner()
+		return nil, nil, err
 	}
-	offer, err := webrtcConn.StartClient("vpx", onIceCandidateCb, onExitCb)
+	hub.AttachOwner(webrtcConn)
+
+	webrtcConn.OnBandwidthEstimate(func(bps int) {
+		if err := relayer.SetBitrate(bps); err != nil {
+			log.Printf("[%s] Couldn't forward bitrate estimate to VM: %s\n", id, err)
+		}
+	})
+
+	onExitCb := func() {
+		// Must close webrtc connection first to ensure no writing to closed inputStream
+		webrtcConn.StopClient()
+		hub.DetachOwner()
+	}
+
+	return webrtcConn, onExitCb, nil
+}
+
+func startSession(id, appName string, wsConn *ws.Connection) (*webrtc.WebRTC, error) {
+	webrtcConn, onExitCb, err := ProvisionSession(id, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	onIceCandidateCb := func(candidate string) {
+		err := sendIceCandidate(wsConn, candidate)
+		if err != nil {
+			log.Printf("[%s] Couldn't send candidate: %s\n", id, err)
+		}
+	}
+
+	hub, _ := GetHub(id)
+
+	offer, err := webrtcConn.StartClient("vpx", onIceCandidateCb, onExitCb, hub.RequestKeyframe)
 	if err != nil {
 		fmt.Printf("[%s] Couldn't start webrtc client: %s\n", id, err)
 		return nil, err
@@ -206,7 +279,10 @@ func NewSession(w http.ResponseWriter, r *http.Request) {
 
 		switch msg.Type {
 		case constants.StartMessage:
-			webrtcConn, err = startSession(sessionId, conn)
+			// msg.Data carries the app name the client wants to launch, the
+			// same way it carries an SDP/candidate payload for the other
+			// message types.
+			webrtcConn, err = startSession(sessionId, msg.Data, conn)
 			if err != nil {
 				log.Printf("[%s] Error when starting new session: %s\n", sessionId, err)
 				webrtcConn = nil
@@ -0,0 +1,176 @@
+// Package stream relays one session's raw VM transport: the video/audio
+// RTP the VM sends over its UDP listeners, the input/health events the VM
+// sends back over its wine TCP connection, and - the other direction over
+// that same TCP connection - the keyframe/bitrate control messages the
+// coordinator sends to steer the VM's encoder.
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"coordinator/app/webrtc"
+
+	"github.com/pion/rtp"
+)
+
+// controlMessage is how the coordinator asks the VM's encoder to do
+// something, framed as newline-delimited JSON over the wine connection -
+// the same connection and encoding syncinput already uses for input
+// events, just in the other direction.
+type controlMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+}
+
+const (
+	controlTypeKeyframe = "keyframe"
+	controlTypeBitrate  = "bitrate"
+)
+
+// StreamRelayer owns the transport for one session: it reads the VM's
+// video/audio RTP off their UDP listeners into the channels a
+// session.SessionHub fans out to every attached webrtc.WebRTC's tracks,
+// reads input events off the wine TCP
+// connection into inputStream, and is the coordinator's end of that same
+// connection for RequestKeyframe/SetBitrate.
+type StreamRelayer struct {
+	id string
+
+	videoStream chan *rtp.Packet
+	audioStream chan *rtp.Packet
+	inputStream chan *webrtc.Packet
+
+	videoListener *net.UDPConn
+	audioListener *net.UDPConn
+	wineListener  net.Listener
+
+	screenWidth  int
+	screenHeight int
+
+	mu       sync.Mutex
+	wineConn net.Conn
+
+	closed chan struct{}
+}
+
+// NewStreamRelayer builds a StreamRelayer for session id. screenWidth and
+// screenHeight are stored on the relayer as given; nothing in the relayer
+// reads them or sends them to the VM.
+func NewStreamRelayer(id string, videoStream, audioStream chan *rtp.Packet, inputStream chan *webrtc.Packet, videoListener, audioListener *net.UDPConn, wineListener net.Listener, screenWidth, screenHeight int) *StreamRelayer {
+	return &StreamRelayer{
+		id:            id,
+		videoStream:   videoStream,
+		audioStream:   audioStream,
+		inputStream:   inputStream,
+		videoListener: videoListener,
+		audioListener: audioListener,
+		wineListener:  wineListener,
+		screenWidth:   screenWidth,
+		screenHeight:  screenHeight,
+		closed:        make(chan struct{}),
+	}
+}
+
+// Start begins relaying in the background: video/audio RTP flows into
+// their streams as soon as it arrives, and the wine TCP connection - once
+// the VM dials in - carries input events inbound and control messages
+// outbound.
+func (r *StreamRelayer) Start() error {
+	go r.relayRTP(r.videoListener, r.videoStream)
+	go r.relayRTP(r.audioListener, r.audioStream)
+	go r.acceptWine()
+
+	return nil
+}
+
+func (r *StreamRelayer) relayRTP(conn *net.UDPConn, out chan *rtp.Packet) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(buf[:n]); err != nil {
+			log.Printf("[%s] Couldn't parse RTP packet from VM: %s\n", r.id, err)
+			continue
+		}
+
+		select {
+		case out <- packet:
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// acceptWine blocks for the VM's single wine connection, then reads input
+// events off it for the rest of the session's lifetime. RequestKeyframe
+// and SetBitrate only have something to write to once the VM has dialed
+// in and Accept has returned.
+func (r *StreamRelayer) acceptWine() {
+	conn, err := r.wineListener.Accept()
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.wineConn = conn
+	r.mu.Unlock()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var packet webrtc.Packet
+		if err := decoder.Decode(&packet); err != nil {
+			return
+		}
+
+		select {
+		case r.inputStream <- &packet:
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// RequestKeyframe asks the VM's encoder to cut a fresh keyframe, driven by
+// webrtc.OnKeyframeCallback via session.SessionHub.RequestKeyframe.
+func (r *StreamRelayer) RequestKeyframe() error {
+	return r.sendControl(controlMessage{Type: controlTypeKeyframe})
+}
+
+// SetBitrate retargets the VM's encoder to bps bits per second, driven by
+// webrtc.WebRTC's OnBandwidthEstimate callback.
+func (r *StreamRelayer) SetBitrate(bps int) error {
+	return r.sendControl(controlMessage{Type: controlTypeBitrate, Data: strconv.Itoa(bps)})
+}
+
+func (r *StreamRelayer) sendControl(msg controlMessage) error {
+	r.mu.Lock()
+	conn := r.wineConn
+	r.mu.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("[%s] wine control connection isn't established yet", r.id)
+	}
+
+	return json.NewEncoder(conn).Encode(msg)
+}
+
+// Close releases the relayer's own state. The caller closes the
+// video/audio/wine listeners itself first, see session.ProvisionSession.
+func (r *StreamRelayer) Close() {
+	close(r.closed)
+
+	r.mu.Lock()
+	if r.wineConn != nil {
+		_ = r.wineConn.Close()
+	}
+	r.mu.Unlock()
+}
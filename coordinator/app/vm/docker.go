@@ -0,0 +1,95 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// sessionLabel tags every container a DockerBackend starts with the
+// session id, so containers can be found and reaped independently of the
+// coordinator's own in-memory state.
+const sessionLabel = "cloud-gaming.session-id"
+
+// DockerBackend runs one container per session on the same Docker host the
+// coordinator itself runs on, in the host's network namespace (see Start).
+// This is a bare-metal-equivalent deployment, not a remote/clustered one -
+// DockerBackend only makes sense when the coordinator and the Docker
+// daemon share a network namespace. For a remote or multi-host fleet, use
+// KubernetesBackend instead.
+type DockerBackend struct {
+	cli   *client.Client
+	Image string
+}
+
+// NewDockerBackend connects to the Docker daemon using the standard
+// DOCKER_HOST/DOCKER_CERT_PATH environment, the same way the docker CLI
+// does.
+func NewDockerBackend(image string) (*DockerBackend, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+
+	return &DockerBackend{cli: cli, Image: image}, nil
+}
+
+// Start runs the VM container with host networking rather than publishing
+// ports: by the time Start is called, session.ProvisionSession has already
+// bound ports.Video/Audio/Wine itself via its own listening sockets, so a
+// published/bound container port of the same number would just fail to
+// bind. Host networking puts the container on the coordinator's own
+// network namespace instead, so the VM process inside can dial
+// 127.0.0.1:<port> directly - exactly how ScriptBackend's VM process
+// already reaches those ports - with no publishing involved. The ports are
+// passed to the container as arguments, the same convention
+// ScriptBackend's startVM.sh uses.
+func (b *DockerBackend) Start(ctx context.Context, id string, ports VMPorts) (VMHandle, error) {
+	resp, err := b.cli.ContainerCreate(ctx, &container.Config{
+		Image:  b.Image,
+		Labels: map[string]string{sessionLabel: id},
+		Cmd: []string{
+			id,
+			strconv.Itoa(ports.Video),
+			strconv.Itoa(ports.Audio),
+			strconv.Itoa(ports.Wine),
+		},
+	}, &container.HostConfig{
+		NetworkMode: "host",
+	}, nil, nil, "")
+	if err != nil {
+		return VMHandle{}, err
+	}
+
+	if err := b.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return VMHandle{}, err
+	}
+
+	return VMHandle{ID: resp.ID}, nil
+}
+
+func (b *DockerBackend) Stop(ctx context.Context, handle VMHandle) error {
+	timeout := 10
+	if err := b.cli.ContainerStop(ctx, handle.ID, container.StopOptions{Timeout: &timeout}); err != nil {
+		return err
+	}
+
+	return b.cli.ContainerRemove(ctx, handle.ID, types.ContainerRemoveOptions{Force: true})
+}
+
+func (b *DockerBackend) HealthCheck(ctx context.Context, handle VMHandle) error {
+	info, err := b.cli.ContainerInspect(ctx, handle.ID)
+	if err != nil {
+		return err
+	}
+
+	if !info.State.Running {
+		return fmt.Errorf("container %s is not running (status %s)", handle.ID, info.State.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+)
+
+// KubernetesBackend provisions a per-session Pod plus a headless Service
+// exposing the video/audio/wine relay ports, for clusters that run the
+// game VM image as a workload instead of a container on a bare Docker
+// host.
+//
+// This is a stub: wiring it up for real needs a client-go Clientset
+// threaded in from main, which this deployment doesn't have yet. It
+// exists so settings.VMBackend can already select "kubernetes" and get a
+// clear error instead of silently falling back to another backend.
+type KubernetesBackend struct {
+	Namespace string
+}
+
+// NewKubernetesBackend returns a KubernetesBackend targeting namespace.
+func NewKubernetesBackend(namespace string) *KubernetesBackend {
+	return &KubernetesBackend{Namespace: namespace}
+}
+
+func (b *KubernetesBackend) Start(ctx context.Context, id string, ports VMPorts) (VMHandle, error) {
+	return VMHandle{}, fmt.Errorf("kubernetes backend: Pod/Service provisioning not implemented yet")
+}
+
+func (b *KubernetesBackend) Stop(ctx context.Context, handle VMHandle) error {
+	return fmt.Errorf("kubernetes backend: Pod/Service teardown not implemented yet")
+}
+
+func (b *KubernetesBackend) HealthCheck(ctx context.Context, handle VMHandle) error {
+	return fmt.Errorf("kubernetes backend: health check not implemented yet")
+}
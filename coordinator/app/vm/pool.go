@@ -0,0 +1,100 @@
+package vm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// PreWarmed is a VM a Pool has already started, ready to be claimed by an
+// incoming session once its relay ports are known.
+type PreWarmed struct {
+	Handle VMHandle
+	Ports  VMPorts
+}
+
+// fillRetryBackoff is how long fill waits after a failed allocPorts or
+// backend.Start before retrying, so a persistently broken backend spins
+// slowly instead of tight-looping and flooding the logs.
+const fillRetryBackoff = 2 * time.Second
+
+// Pool keeps a buffer of pre-warmed VMs topped up in the background, for
+// backends whose Start is too slow to run in the request path (scheduling
+// a Kubernetes Pod can take seconds a player shouldn't have to wait out).
+//
+// Nothing constructs a Pool yet: the only backend slow enough to need one,
+// KubernetesBackend, is still a stub whose Start always errors (see
+// kubernetes.go), so there's no real VM for a Pool to pre-warm. Wire one up
+// in vmBackend/ProvisionSession once KubernetesBackend actually provisions
+// Pods, using allocPorts to open the relay listeners a pre-warmed VM needs
+// before a session claims it.
+type Pool struct {
+	backend    Backend
+	allocPorts func() (VMPorts, error)
+	ready      chan PreWarmed
+}
+
+// NewPool starts size background goroutines that keep calling allocPorts
+// and backend.Start, queueing the result on ready and topping the pool
+// back up as fast as Claim drains it.
+func NewPool(backend Backend, size int, allocPorts func() (VMPorts, error)) *Pool {
+	p := &Pool{
+		backend:    backend,
+		allocPorts: allocPorts,
+		ready:      make(chan PreWarmed, size),
+	}
+	for i := 0; i < size; i++ {
+		go p.fill()
+	}
+
+	return p
+}
+
+func (p *Pool) fill() {
+	for {
+		ports, err := p.allocPorts()
+		if err != nil {
+			log.Printf("Couldn't allocate relay ports to pre-warm a VM: %s\n", err)
+			time.Sleep(fillRetryBackoff)
+			continue
+		}
+
+		id, err := newPreWarmID()
+		if err != nil {
+			log.Printf("Couldn't generate a pre-warmed VM id: %s\n", err)
+			time.Sleep(fillRetryBackoff)
+			continue
+		}
+
+		handle, err := p.backend.Start(context.Background(), id, ports)
+		if err != nil {
+			log.Printf("Couldn't pre-warm VM: %s\n", err)
+			time.Sleep(fillRetryBackoff)
+			continue
+		}
+
+		p.ready <- PreWarmed{Handle: handle, Ports: ports}
+	}
+}
+
+// newPreWarmID gives each pre-warmed VM its own id, so concurrent fill
+// goroutines never hand the same id to two backend.Start calls at once.
+func newPreWarmID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "pre-warmed-" + hex.EncodeToString(buf), nil
+}
+
+// Claim blocks until a pre-warmed VM is available or ctx is done.
+func (p *Pool) Claim(ctx context.Context) (PreWarmed, error) {
+	select {
+	case warm := <-p.ready:
+		return warm, nil
+	case <-ctx.Done():
+		return PreWarmed{}, ctx.Err()
+	}
+}
@@ -0,0 +1,47 @@
+package vm
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+)
+
+// ScriptBackend runs the pre-existing startVM.sh/stopVM.sh scripts. It's
+// the original single-host deployment model and the default backend.
+type ScriptBackend struct {
+	StartScript string
+	StopScript  string
+}
+
+// NewScriptBackend returns a ScriptBackend that shells out to
+// ./startVM.sh and ./stopVM.sh, as the coordinator always has.
+func NewScriptBackend() *ScriptBackend {
+	return &ScriptBackend{StartScript: "./startVM.sh", StopScript: "./stopVM.sh"}
+}
+
+func (b *ScriptBackend) Start(ctx context.Context, id string, ports VMPorts) (VMHandle, error) {
+	params := []string{
+		id,
+		strconv.Itoa(ports.Video),
+		strconv.Itoa(ports.Audio),
+		strconv.Itoa(ports.Wine),
+	}
+
+	cmd := exec.CommandContext(ctx, b.StartScript, params...)
+	if err := cmd.Start(); err != nil {
+		return VMHandle{}, err
+	}
+
+	return VMHandle{ID: id}, nil
+}
+
+func (b *ScriptBackend) Stop(ctx context.Context, handle VMHandle) error {
+	cmd := exec.CommandContext(ctx, b.StopScript, handle.ID)
+	return cmd.Start()
+}
+
+// HealthCheck is a no-op: the script backend has no process handle to
+// poll, startVM.sh is fire-and-forget.
+func (b *ScriptBackend) HealthCheck(ctx context.Context, handle VMHandle) error {
+	return nil
+}
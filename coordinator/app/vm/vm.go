@@ -0,0 +1,50 @@
+// Package vm abstracts how a session's game VM is provisioned, so the
+// session package isn't tied to shelling out to startVM.sh/stopVM.sh on a
+// single host. Swapping Backend implementations is how the same
+// coordinator targets a bare-metal host, a Docker host, or a Kubernetes
+// cluster.
+package vm
+
+import (
+	"context"
+	"fmt"
+)
+
+// VMPorts are the coordinator-side relay ports the VM must send its
+// video/audio/input traffic to, allocated by session.ProvisionSession
+// before a Backend starts anything.
+type VMPorts struct {
+	Video int
+	Audio int
+	Wine  int
+}
+
+// VMHandle identifies a running VM to the Backend that started it. Its
+// ID is backend-specific (a PID's session id, a container id, a Pod
+// name) and opaque to callers outside this package.
+type VMHandle struct {
+	ID string
+}
+
+// Backend starts, stops and health-checks the VM for a session.
+type Backend interface {
+	Start(ctx context.Context, id string, ports VMPorts) (VMHandle, error)
+	Stop(ctx context.Context, handle VMHandle) error
+	HealthCheck(ctx context.Context, handle VMHandle) error
+}
+
+// NewBackend constructs a Backend by name, as picked by operator config
+// (settings.VMBackend). An empty kind means "script", the original
+// single-host deployment.
+func NewBackend(kind string) (Backend, error) {
+	switch kind {
+	case "", "script":
+		return NewScriptBackend(), nil
+	case "docker":
+		return NewDockerBackend("cloud-gaming-vm")
+	case "kubernetes":
+		return NewKubernetesBackend("default"), nil
+	default:
+		return nil, fmt.Errorf("unknown VM backend %q", kind)
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"coordinator/utils"
 	"encoding/json"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	sdp "github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 	"log"
 	"net"
@@ -16,13 +20,18 @@ import (
 type WebRTC struct {
 	id           string // for logging
 	conn         *webrtc.PeerConnection
-	imageChannel chan *rtp.Packet
-	audioChannel chan *rtp.Packet
+	videoTrack   *webrtc.TrackLocalStaticRTP
+	audioTrack   *webrtc.TrackLocalStaticRTP
 	eventChannel chan *Packet
 	exitOnce     sync.Once
 	inputTrack   *webrtc.DataChannel
 	healthTrack  *webrtc.DataChannel
 	closed       chan struct{}
+	estimator    cc.BandwidthEstimator
+	maxBitrate   int
+
+	connectedMu sync.RWMutex
+	connected   bool
 }
 
 type Packet struct {
@@ -33,18 +42,73 @@ type Packet struct {
 type OnIceCallback func(candidate string)
 type OnExitCallback func()
 
+// OnKeyframeCallback fires when a viewer's RTCP feedback (PLI/FIR, or too
+// much loss on a receiver report) indicates the encoder should cut a fresh
+// keyframe. readRTCP calls it on every such signal with no debounce of its
+// own - when several viewers share one VM via a session.SessionHub, the
+// hub is what debounces so a burst of feedback from all of them only
+// reaches the VM once.
+type OnKeyframeCallback func()
+
+// OnBandwidthEstimateCallback fires with the congestion controller's latest
+// target send bitrate in bits per second, so a caller can forward it to the
+// VM and have the encoder retarget its output.
+type OnBandwidthEstimateCallback func(bps int)
+
 type PortRange struct {
 	Min uint16
 	Max uint16
 }
 
+// ICEServer is an operator-configured STUN/TURN server, including
+// credentials for TURN. When Config.ICEServers is empty, NewWebRTC falls
+// back to a single public STUN server.
+type ICEServer struct {
+	URLs       []string
+	Username   string
+	Credential string
+}
+
+// ICETimeouts configures webrtc.SettingEngine.SetICETimeouts. Any zero value
+// falls back to its Default* constant.
+type ICETimeouts struct {
+	Disconnected time.Duration
+	Failed       time.Duration
+	KeepAlive    time.Duration
+}
+
+// Default ICE timeouts, matching the values neko uses in production.
+const (
+	DefaultICEDisconnectedTimeout = 4 * time.Second
+	DefaultICEFailedTimeout       = 6 * time.Second
+	DefaultICEKeepAliveInterval   = 2 * time.Second
+)
+
 type Config struct {
 	SinglePort                 int
 	PortRange                  PortRange
 	IceIpMap                   string
 	DisableDefaultInterceptors bool
+	ICEServers                 []ICEServer
+	ICETimeouts                ICETimeouts
+	InitialBitrate             int
+	MinBitrate                 int
+	MaxBitrate                 int
 }
 
+// DefaultKeyframeDebounce matches the PLI interval used by
+// plugin-webrtc-plus. session.SessionHub uses this as the default interval
+// for debouncing keyframe requests shared across every viewer of a session.
+const DefaultKeyframeDebounce = 2 * time.Second
+
+// Default bitrate bounds (bps) used when an app doesn't configure its own
+// in appconf/apps.yml.
+const (
+	DefaultInitialBitrate = 2_000_000
+	DefaultMinBitrate     = 500_000
+	DefaultMaxBitrate     = 4_000_000
+)
+
 var (
 	settings    webrtc.SettingEngine
 	settingOnce sync.Once
@@ -52,13 +116,52 @@ var (
 
 const MaxMissedHealthCheck int = 5
 
-func NewWebRTC(id string, videoStream, audioStream chan *rtp.Packet, inputStream chan *Packet, conf *Config) (*WebRTC, error) {
+// NewWebRTC sets up a peer connection for session id. inputStream receives
+// parsed data-channel messages and should be nil for read-only spectator
+// connections, which aren't allowed to drive input. Video/audio aren't fed
+// in here: once the connection is attached to a session.SessionHub the hub
+// pushes RTP packets straight to WriteVideoRTP/WriteAudioRTP.
+func NewWebRTC(id string, inputStream chan *Packet, conf *Config) (*WebRTC, error) {
 	m := &webrtc.MediaEngine{}
-	if err := m.RegisterDefaultCodecs(); err != nil {
+	if err := registerCodecs(m); err != nil {
 		return nil, err
 	}
 
+	initialBitrate := conf.InitialBitrate
+	if initialBitrate <= 0 {
+		initialBitrate = DefaultInitialBitrate
+	}
+	minBitrate := conf.MinBitrate
+	if minBitrate <= 0 {
+		minBitrate = DefaultMinBitrate
+	}
+	maxBitrate := conf.MaxBitrate
+	if maxBitrate <= 0 {
+		maxBitrate = DefaultMaxBitrate
+	}
+
 	i := &interceptor.Registry{}
+
+	var estimator cc.BandwidthEstimator
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBitrate),
+			gcc.SendSideBWEMinBitrate(minBitrate),
+			gcc.SendSideBWEMaxBitrate(maxBitrate),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	congestionController.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) {
+		estimator = e
+	})
+	i.Add(congestionController)
+
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, err
+	}
+
 	if !conf.DisableDefaultInterceptors {
 		if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
 			return nil, err
@@ -86,6 +189,22 @@ func NewWebRTC(id string, videoStream, audioStream chan *rtp.Packet, inputStream
 			settingEngine.SetNAT1To1IPs([]string{conf.IceIpMap}, webrtc.ICECandidateTypeHost)
 		}
 
+		disconnectedTimeout := conf.ICETimeouts.Disconnected
+		if disconnectedTimeout <= 0 {
+			disconnectedTimeout = DefaultICEDisconnectedTimeout
+		}
+		failedTimeout := conf.ICETimeouts.Failed
+		if failedTimeout <= 0 {
+			failedTimeout = DefaultICEFailedTimeout
+		}
+		keepAliveInterval := conf.ICETimeouts.KeepAlive
+		if keepAliveInterval <= 0 {
+			keepAliveInterval = DefaultICEKeepAliveInterval
+		}
+		if err := settingEngine.SetICETimeouts(disconnectedTimeout, failedTimeout, keepAliveInterval); err != nil {
+			panic(err)
+		}
+
 		settings = settingEngine
 	})
 
@@ -96,10 +215,8 @@ func NewWebRTC(id string, videoStream, audioStream chan *rtp.Packet, inputStream
 	)
 
 	conn, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		}},
-	)
+		ICEServers: iceServers(conf.ICEServers),
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -107,14 +224,26 @@ func NewWebRTC(id string, videoStream, audioStream chan *rtp.Packet, inputStream
 	return &WebRTC{
 		id:           id,
 		conn:         conn,
-		imageChannel: videoStream,
-		audioChannel: audioStream,
 		eventChannel: inputStream,
 		closed:       make(chan struct{}),
+		estimator:    estimator,
+		maxBitrate:   maxBitrate,
 	}, nil
 }
 
-func (w *WebRTC) StartClient(vCodec string, iceCb OnIceCallback, exitCb OnExitCallback) (string, error) {
+// OnBandwidthEstimate registers cb to fire every time the congestion
+// controller's target send bitrate changes, so a caller can forward it to
+// the VM and have the encoder retarget its output to match the link.
+func (w *WebRTC) OnBandwidthEstimate(cb OnBandwidthEstimateCallback) {
+	if w.estimator == nil {
+		return
+	}
+	w.estimator.OnTargetBitrateChange(func(bitrate int) {
+		cb(bitrate)
+	})
+}
+
+func (w *WebRTC) StartClient(vCodec string, iceCb OnIceCallback, exitCb OnExitCallback, keyframeCb OnKeyframeCallback) (string, error) {
 	log.Printf("[%s] Start WebRTC..\n", w.id)
 
 	// Create and add video track
@@ -125,10 +254,11 @@ func (w *WebRTC) StartClient(vCodec string, iceCb OnIceCallback, exitCb OnExitCa
 		return "", err
 	}
 
-	_, err = w.conn.AddTrack(videoTrack)
+	videoSender, err := w.conn.AddTrack(videoTrack)
 	if err != nil {
 		return "", err
 	}
+	w.readRTCP(videoSender, keyframeCb)
 
 	// Create and add audio  track
 	opusTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
@@ -143,6 +273,9 @@ func (w *WebRTC) StartClient(vCodec string, iceCb OnIceCallback, exitCb OnExitCa
 		return "", err
 	}
 
+	w.videoTrack = videoTrack
+	w.audioTrack = opusTrack
+
 	err = w.addInputTrack()
 	if err != nil {
 		return "", err
@@ -156,7 +289,7 @@ func (w *WebRTC) StartClient(vCodec string, iceCb OnIceCallback, exitCb OnExitCa
 	w.conn.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		if state == webrtc.ICEConnectionStateConnected {
 			log.Printf("[%s] ICE Connected succeeded\n", w.id)
-			w.startStreaming(videoTrack, opusTrack)
+			w.setConnected(keyframeCb)
 		}
 
 		if state == webrtc.ICEConnectionStateFailed || state == webrtc.ICEConnectionStateClosed || state == webrtc.ICEConnectionStateDisconnected {
@@ -182,6 +315,12 @@ func (w *WebRTC) StartClient(vCodec string, iceCb OnIceCallback, exitCb OnExitCa
 		return "", err
 	}
 
+	if withTIAS, err := setVideoTIAS(offer.SDP, w.maxBitrate); err != nil {
+		log.Printf("[%s] Couldn't set TIAS bandwidth on offer, leaving it unset: %s\n", w.id, err)
+	} else {
+		offer.SDP = withTIAS
+	}
+
 	err = w.conn.SetLocalDescription(offer)
 	if err != nil {
 		return "", err
@@ -209,7 +348,11 @@ func (w *WebRTC) addInputTrack() error {
 			return
 		}
 
-		w.eventChannel <- &msg
+		// Spectator connections are created without an event channel since
+		// only the session owner is allowed to drive input.
+		if w.eventChannel != nil {
+			w.eventChannel <- &msg
+		}
 	})
 	return nil
 }
@@ -288,31 +431,312 @@ func (w *WebRTC) AddCandidate(candidate string) error {
 	return nil
 }
 
+// SetRemoteOffer sets the peer's SDP offer directly from raw SDP text, as
+// opposed to SetRemoteSDP which expects our base64-encoded WS envelope.
+// This is the entry point for HTTP signaling flows (WHIP/WHEP) where the
+// offer arrives as the literal `application/sdp` request body.
+func (w *WebRTC) SetRemoteOffer(offerSDP string) error {
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerSDP,
+	}
+
+	if err := w.conn.SetRemoteDescription(offer); err != nil {
+		log.Printf("[%s] Set remote offer failed: %s\n", w.id, err)
+		return err
+	}
+
+	return nil
+}
+
+// CreateAnswer plays the answerer role for HTTP signaling flows: the remote
+// offer must already be set via SetRemoteOffer. It mirrors StartClient's
+// track/state setup but returns a plain SDP answer instead of an offer.
+// When trickle is false it blocks until ICE gathering completes so the
+// returned answer already carries every local candidate; when true, iceCb
+// fires for each candidate as it's discovered and callers are expected to
+// relay it on their own transport (e.g. a WHEP trickle PATCH).
+func (w *WebRTC) CreateAnswer(vCodec string, trickle bool, iceCb OnIceCallback, exitCb OnExitCallback, keyframeCb OnKeyframeCallback) (string, error) {
+	log.Printf("[%s] Start WebRTC (HTTP answerer)..\n", w.id)
+
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType: verbalCodecToMime(vCodec),
+	}, "video", "pion")
+	if err != nil {
+		return "", err
+	}
+	videoSender, err := w.conn.AddTrack(videoTrack)
+	if err != nil {
+		return "", err
+	}
+	w.readRTCP(videoSender, keyframeCb)
+
+	opusTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType: webrtc.MimeTypeOpus,
+	}, "audio", "pion")
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.conn.AddTrack(opusTrack); err != nil {
+		return "", err
+	}
+
+	w.videoTrack = videoTrack
+	w.audioTrack = opusTrack
+
+	w.conn.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			log.Printf("[%s] ICE Connected succeeded\n", w.id)
+			w.setConnected(keyframeCb)
+		}
+
+		if state == webrtc.ICEConnectionStateFailed || state == webrtc.ICEConnectionStateClosed || state == webrtc.ICEConnectionStateDisconnected {
+			log.Printf("[%s] ICE Connected failed: %s\n", w.id, state)
+			w.Exit(exitCb)
+		}
+	})
+
+	if trickle {
+		w.conn.OnICECandidate(func(iceCandidate *webrtc.ICECandidate) {
+			if iceCandidate != nil {
+				iceCb(iceCandidate.ToJSON().Candidate)
+			}
+		})
+	}
+
+	answer, err := w.conn.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(w.conn)
+
+	if err = w.conn.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	if !trickle {
+		<-gatherComplete
+	}
+
+	return w.conn.LocalDescription().SDP, nil
+}
+
+// AddTrickleCandidate adds a raw (non-base64) ICE candidate line to the peer
+// connection, as trickled in over a WHIP/WHEP PATCH request.
+func (w *WebRTC) AddTrickleCandidate(candidate string) error {
+	err := w.conn.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate})
+	if err != nil {
+		log.Printf("[%s] Add trickled Ice candidate failed: %s\n", w.id, err)
+		return err
+	}
+
+	return nil
+}
+
 func (w *WebRTC) StopClient() {
 	w.conn.Close()
-	w.inputTrack.Close()
-	w.healthTrack.Close()
+	if w.inputTrack != nil {
+		w.inputTrack.Close()
+	}
+	if w.healthTrack != nil {
+		w.healthTrack.Close()
+	}
 	w.closed <- struct{}{}
 }
 
-func (w *WebRTC) startStreaming(videoTrack *webrtc.TrackLocalStaticRTP, opusTrack *webrtc.TrackLocalStaticRTP) {
-	go func() {
-		for packet := range w.imageChannel {
-			if err := videoTrack.WriteRTP(packet); err != nil {
-				log.Printf("[%s] Error when writing RTP to video track: %s\n", w.id, err)
-			}
+// Exit runs exitCb at most once, no matter whether it's triggered by an ICE
+// state change inside this package or by a caller tearing the session down
+// from the outside (e.g. a WHEP DELETE).
+func (w *WebRTC) Exit(exitCb OnExitCallback) {
+	w.exitOnce.Do(exitCb)
+}
+
+// WriteVideoRTP forwards an RTP packet to this connection's video track.
+// It's the fan-out point a session.SessionHub writes through for both the
+// owner and every attached spectator.
+func (w *WebRTC) WriteVideoRTP(packet *rtp.Packet) error {
+	if w.videoTrack == nil {
+		return nil
+	}
+	return w.videoTrack.WriteRTP(packet)
+}
+
+// WriteAudioRTP is WriteVideoRTP's counterpart for the audio track.
+func (w *WebRTC) WriteAudioRTP(packet *rtp.Packet) error {
+	if w.audioTrack == nil {
+		return nil
+	}
+	return w.audioTrack.WriteRTP(packet)
+}
+
+// Connected reports whether ICE has finished connecting. A
+// session.SessionHub checks this before fanning a packet out to a
+// connection, since writing to its tracks before then would just be
+// discarded by the still-negotiating peer.
+func (w *WebRTC) Connected() bool {
+	w.connectedMu.RLock()
+	defer w.connectedMu.RUnlock()
+	return w.connected
+}
+
+// setConnected marks the connection ready for session.SessionHub's fan-out
+// and asks the VM for a fresh keyframe, so a peer that only just finished
+// ICE negotiation gets a full picture right away instead of waiting on the
+// next PLI/loss-triggered one.
+func (w *WebRTC) setConnected(keyframeCb OnKeyframeCallback) {
+	w.connectedMu.Lock()
+	w.connected = true
+	w.connectedMu.Unlock()
+
+	if keyframeCb != nil {
+		keyframeCb()
+	}
+}
+
+// videoRTCPFeedback is the RTCPFeedback every video codec is registered
+// with, so browsers actually emit NACK/PLI/FIR for readRTCP to react to.
+var videoRTCPFeedback = []webrtc.RTCPFeedback{
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+	{Type: "ccm", Parameter: "fir"},
+}
+
+// registerCodecs registers VP8, H264 and Opus by hand instead of relying on
+// RegisterDefaultCodecs, so the video codecs carry the RTCPFeedback entries
+// readRTCP depends on.
+func registerCodecs(m *webrtc.MediaEngine) error {
+	videoCodecs := []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeVP8,
+				ClockRate:    90000,
+				RTCPFeedback: videoRTCPFeedback,
+			},
+			PayloadType: 96,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeH264,
+				ClockRate:    90000,
+				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+				RTCPFeedback: videoRTCPFeedback,
+			},
+			PayloadType: 102,
+		},
+	}
+	for _, codec := range videoCodecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
 		}
-	}()
+	}
+
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeOpus,
+			ClockRate: 48000,
+			Channels:  2,
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio)
+}
 
+// highLossFractionThreshold is the fraction of packets lost, read off an
+// RTCP ReceiverReport (whose FractionLost is out of 256), at or above which
+// readRTCP treats the report the same as an explicit PLI/FIR.
+const highLossFractionThreshold = 0.25
+
+// readRTCP watches a video RTPSender for PictureLossIndication/
+// FullIntraRequest, or a ReceiverReport showing heavy loss, and asks the
+// VM for a fresh keyframe. It has no debounce of its own - keyframeCb can
+// be invoked as often as feedback arrives, so callers that fan one VM out
+// to several viewers (session.SessionHub) must debounce on their end,
+// shared across every attached connection.
+func (w *WebRTC) readRTCP(sender *webrtc.RTPSender, keyframeCb OnKeyframeCallback) {
 	go func() {
-		for packet := range w.audioChannel {
-			if err := opusTrack.WriteRTP(packet); err != nil {
-				log.Printf("[%s] Error when writing RTP to opus track: %s\n", w.id, err)
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := sender.Read(buf)
+			if err != nil {
+				return
+			}
+
+			packets, err := rtcp.Unmarshal(buf[:n])
+			if err != nil {
+				continue
+			}
+
+			if keyframeCb == nil {
+				continue
+			}
+
+			for _, packet := range packets {
+				switch p := packet.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					log.Printf("[%s] PLI/FIR received, requesting keyframe from VM\n", w.id)
+					keyframeCb()
+				case *rtcp.ReceiverReport:
+					for _, report := range p.Reports {
+						if float64(report.FractionLost)/256 >= highLossFractionThreshold {
+							log.Printf("[%s] High packet loss reported (%d/256), requesting keyframe from VM\n", w.id, report.FractionLost)
+							keyframeCb()
+						}
+					}
+				}
 			}
 		}
 	}()
 }
 
+// iceServers converts the operator-configured ICE servers to pion's type,
+// falling back to a single public STUN server when none are configured.
+func iceServers(configured []ICEServer) []webrtc.ICEServer {
+	if len(configured) == 0 {
+		return []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+		}
+	}
+
+	servers := make([]webrtc.ICEServer, len(configured))
+	for idx, s := range configured {
+		servers[idx] = webrtc.ICEServer{
+			URLs:       s.URLs,
+			Username:   s.Username,
+			Credential: s.Credential,
+		}
+	}
+
+	return servers
+}
+
+// setVideoTIAS parses offerSDP, appends a `b=TIAS:` line to the video
+// m-section advertising bps as the target bandwidth, and remarshals it.
+// This tells downstream SFUs and browsers the encoder's target bitrate up
+// front, rather than letting them guess from the codec alone.
+func setVideoTIAS(offerSDP string, bps int) (string, error) {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offerSDP)); err != nil {
+		return "", err
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		media.Bandwidth = append(media.Bandwidth, sdp.Bandwidth{
+			Type:      "TIAS",
+			Bandwidth: uint64(bps),
+		})
+	}
+
+	marshaled, err := parsed.Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	return string(marshaled), nil
+}
+
 func verbalCodecToMime(vCodec string) string {
 	switch vCodec {
 	case "h264":
@@ -322,4 +746,4 @@ func verbalCodecToMime(vCodec string) string {
 	default:
 		return webrtc.MimeTypeVP8
 	}
-}
\ No newline at end of file
+}
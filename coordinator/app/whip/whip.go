@@ -0,0 +1,188 @@
+// Package whip implements WHEP (WebRTC-HTTP Egress Protocol) HTTP signaling
+// as an alternative to the custom JSON-over-WebSocket flow in app/session.
+// It reuses the same VM/WebRTC provisioning so a plain browser client can
+// connect without speaking our WS protocol. WHIP (ingestion) endpoints are
+// not provided.
+package whip
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"coordinator/app/session"
+	"coordinator/app/webrtc"
+)
+
+const (
+	sdpMimeType        = "application/sdp"
+	trickleIceMimeType = "application/trickle-ice-sdpfrag"
+)
+
+type whepSession struct {
+	webrtcConn *webrtc.WebRTC
+	onExit     func()
+	token      string
+}
+
+var (
+	sessions   = map[string]*whepSession{}
+	sessionsMu sync.Mutex
+)
+
+func newRandomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// NewWhep handles `POST /whep/{app}`. The request body is the client's SDP
+// offer; the response is the SDP answer, a Location header pointing at the
+// new session resource, and a bearer token subsequent requests must present.
+func NewWhep(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != sdpMimeType {
+		http.Error(w, "Content-Type must be "+sdpMimeType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offerSDP, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Couldn't read SDP offer", http.StatusBadRequest)
+		return
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		log.Printf("Couldn't generate WHEP session id: %s\n", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	appName := strings.TrimPrefix(r.URL.Path, "/whep/")
+
+	webrtcConn, onExit, err := session.ProvisionSession(id, appName)
+	if err != nil {
+		log.Printf("[%s] Couldn't provision WHEP session: %s\n", id, err)
+		http.Error(w, "Couldn't start session", http.StatusInternalServerError)
+		return
+	}
+
+	if err := webrtcConn.SetRemoteOffer(string(offerSDP)); err != nil {
+		webrtcConn.Exit(onExit)
+		http.Error(w, "Invalid SDP offer", http.StatusBadRequest)
+		return
+	}
+
+	_, trickle := r.URL.Query()["trickle"]
+
+	hub, _ := session.GetHub(id)
+
+	answerSDP, err := webrtcConn.CreateAnswer("vpx", trickle, func(candidate string) {
+		log.Printf("[%s] New local ICE candidate: %s\n", id, candidate)
+	}, onExit, hub.RequestKeyframe)
+	if err != nil {
+		log.Printf("[%s] Couldn't create WHEP answer: %s\n", id, err)
+		webrtcConn.Exit(onExit)
+		http.Error(w, "Couldn't create SDP answer", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := newRandomID()
+	if err != nil {
+		log.Printf("[%s] Couldn't generate WHEP session token: %s\n", id, err)
+		webrtcConn.Exit(onExit)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	sessionsMu.Lock()
+	sessions[id] = &whepSession{webrtcConn: webrtcConn, onExit: onExit, token: token}
+	sessionsMu.Unlock()
+
+	w.Header().Set("Content-Type", sdpMimeType)
+	w.Header().Set("Location", "/whep/session/"+id)
+	w.Header().Set("Authorization", "Bearer "+token)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(answerSDP))
+}
+
+// PatchWhepSession handles `PATCH /whep/session/{id}`, adding ICE candidates
+// trickled in by the client as an application/trickle-ice-sdpfrag body.
+func PatchWhepSession(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != trickleIceMimeType {
+		http.Error(w, "Content-Type must be "+trickleIceMimeType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	id, sess, ok := lookupSession(w, r)
+	if !ok {
+		return
+	}
+
+	fragment, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Couldn't read ICE fragment", http.StatusBadRequest)
+		return
+	}
+
+	for _, line := range strings.Split(string(fragment), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		if err := sess.webrtcConn.AddTrickleCandidate(strings.TrimPrefix(line, "a=")); err != nil {
+			log.Printf("[%s] Couldn't add trickled ICE candidate: %s\n", id, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteWhepSession handles `DELETE /whep/session/{id}`, tearing the
+// session down exactly as an ICE failure on the WebSocket flow would.
+func DeleteWhepSession(w http.ResponseWriter, r *http.Request) {
+	id, sess, ok := lookupSession(w, r)
+	if !ok {
+		return
+	}
+
+	sessionsMu.Lock()
+	delete(sessions, id)
+	sessionsMu.Unlock()
+
+	log.Printf("[%s] WHEP session deleted by client\n", id)
+	sess.webrtcConn.Exit(sess.onExit)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func lookupSession(w http.ResponseWriter, r *http.Request) (string, *whepSession, bool) {
+	id := strings.TrimPrefix(r.URL.Path, "/whep/session/")
+	if id == "" {
+		http.Error(w, "Missing session id", http.StatusBadRequest)
+		return "", nil, false
+	}
+
+	sessionsMu.Lock()
+	sess, found := sessions[id]
+	sessionsMu.Unlock()
+	if !found {
+		http.Error(w, "Unknown WHEP session", http.StatusNotFound)
+		return "", nil, false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(sess.token)) != 1 {
+		http.Error(w, "Invalid or missing bearer token", http.StatusUnauthorized)
+		return "", nil, false
+	}
+
+	return id, sess, true
+}
@@ -0,0 +1,87 @@
+// Package settings centralizes operator-configurable deployment values -
+// STUN/TURN servers and ICE tuning today, more as other packages need them
+// - read from the environment once at startup instead of scattering
+// os.Getenv calls through app/session and app/webrtc.
+package settings
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// StunURL is the default (and, absent TurnURL, only) ICE server. It
+	// falls back to the public STUN server the coordinator always used
+	// before operator-configurable ICE servers existed.
+	StunURL = getEnv("STUN_URL", "stun:stun.l.google.com:19302")
+
+	// TurnURL, if set, is added as a second ICE server alongside StunURL,
+	// authenticated with TurnUsername/TurnCredential.
+	TurnURL        = os.Getenv("TURN_URL")
+	TurnUsername   = os.Getenv("TURN_USERNAME")
+	TurnCredential = os.Getenv("TURN_CREDENTIAL")
+
+	// ICEPortMin/ICEPortMax bound the ephemeral UDP port range pion uses
+	// for ICE candidates. Leaving both zero disables the range (pion picks
+	// an OS-assigned port per candidate).
+	ICEPortMin = getEnvUint16("ICE_PORT_MIN", 0)
+	ICEPortMax = getEnvUint16("ICE_PORT_MAX", 0)
+
+	// ICESinglePort, if set and ICEPortMin/Max aren't, muxes every ICE
+	// candidate through one UDP port instead of a range - see
+	// webrtc.NewWebRTC's use of socket.NewSocketPortRoll.
+	ICESinglePort = getEnvInt("ICE_SINGLE_PORT", 0)
+
+	// NAT1To1IP maps the coordinator's private address to a public one for
+	// host candidates, for deployments behind cloud NAT.
+	NAT1To1IP = os.Getenv("NAT_1_TO_1_IP")
+
+	// ICE*Timeout/Interval configure webrtc.SettingEngine.SetICETimeouts.
+	// The defaults match the values neko uses in production; see
+	// webrtc.DefaultICE*.
+	ICEDisconnectedTimeout = getEnvDuration("ICE_DISCONNECTED_TIMEOUT", 4*time.Second)
+	ICEFailedTimeout       = getEnvDuration("ICE_FAILED_TIMEOUT", 6*time.Second)
+	ICEKeepAliveInterval   = getEnvDuration("ICE_KEEPALIVE_INTERVAL", 2*time.Second)
+
+	// ScreenWidth/ScreenHeight are the resolution passed to
+	// stream.NewStreamRelayer. The relayer stores them; it does not send
+	// them to the VM.
+	ScreenWidth  = getEnvInt("SCREEN_WIDTH", 1280)
+	ScreenHeight = getEnvInt("SCREEN_HEIGHT", 720)
+
+	// VMBackend selects the vm.Backend implementation vmBackend builds:
+	// "script" (the default), "docker", or "kubernetes". See vm.NewBackend.
+	VMBackend = os.Getenv("VM_BACKEND")
+)
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getEnvUint16(key string, fallback uint16) uint16 {
+	v, err := strconv.ParseUint(os.Getenv(key), 10, 16)
+	if err != nil {
+		return fallback
+	}
+	return uint16(v)
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}